@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// format picks the representation Details and List render: the normal
+// HTML template, a JSON dump of the underlying structs, or a HAR 1.2
+// document for Details. It is chosen from the `format` query parameter,
+// falling back to the Accept header, and defaults to "html".
+func format(r *http.Request) string {
+	switch r.FormValue("format") {
+	case "json", "har":
+		return r.FormValue("format")
+	}
+
+	switch r.Header.Get("Accept") {
+	case "application/json":
+		return "json"
+	case "application/json+har":
+		return "har"
+	}
+
+	return "html"
+}
+
+// harLog is the root of a HAR 1.2 document.
+// See http://www.softwareishard.com/blog/har-12-spec/.
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string           `json:"startedDateTime"`
+	Time            float64          `json:"time"`
+	Request         harRequest       `json:"request"`
+	Response        harResponse      `json:"response"`
+	Cache           struct{}         `json:"cache"`
+	Timings         harTimings       `json:"timings"`
+	AppEngine       harAppEngineInfo `json:"_appengine"`
+}
+
+type harRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type harResponse struct {
+	Status int `json:"status"`
+}
+
+type harTimings struct {
+	Wait float64 `json:"wait"`
+}
+
+// harAppEngineInfo is a custom, non-standard HAR field carrying the App
+// Engine specific cost and stack trace data that doesn't map cleanly
+// onto HAR's HTTP-centric schema.
+type harAppEngineInfo struct {
+	CostMicros int64    `json:"cost_micros"`
+	Stack      []string `json:"stack,omitempty"`
+}
+
+// writeJSON renders the RequestStats tree from full as JSON.
+func writeJSON(w http.ResponseWriter, full *stats_full) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Record *RequestStats `json:"record"`
+		Header http.Header   `json:"header"`
+	}{
+		Record: full.Stats,
+		Header: full.Header,
+	})
+}
+
+// writeHAR renders full's RPCStats as a HAR 1.2 document, one entry per
+// RPC, with App Engine specific cost and stack data attached under the
+// non-standard "_appengine" field.
+func writeHAR(w http.ResponseWriter, full *stats_full) {
+	log := harLog{
+		Log: harLogBody{
+			Version: "1.2",
+			Creator: harCreator{Name: "appstats", Version: "1"},
+		},
+	}
+
+	for _, s := range full.Stats.RPCStats {
+		log.Log.Entries = append(log.Log.Entries, harEntry{
+			StartedDateTime: s.Start.Format(time.RFC3339Nano),
+			Time:            s.Duration.Seconds() * 1000,
+			Request:         harRequest{Method: "RPC", URL: s.Name()},
+			Response:        harResponse{Status: 200},
+			Timings:         harTimings{Wait: s.Duration.Seconds() * 1000},
+			AppEngine: harAppEngineInfo{
+				CostMicros: s.Cost,
+				Stack:      s.StackData,
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(log)
+}
+
+// writeListJSON renders records as JSON for external dashboards that
+// want structured data instead of scraping the HTML list view.
+func writeListJSON(w http.ResponseWriter, records []Record) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Records []Record `json:"records"`
+	}{Records: records})
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const flameURL = "/appstats/flame"
+
+// rowHeight and svgWidth are the layout constants used by both the flame
+// graph and the Gantt chart SVG renderers.
+const (
+	rowHeight = 18
+	svgWidth  = 1200
+)
+
+// serviceColors cycles a small fixed palette keyed by RPC service name
+// so the same service always renders the same color within one SVG.
+var serviceColors = []string{
+	"#e07b39", "#5b8c5a", "#3f72af", "#a64ca6", "#c9a227", "#6b6b6b",
+}
+
+func colorFor(service string) string {
+	var h int
+	for _, c := range service {
+		h = h*31 + int(c)
+	}
+	if h < 0 {
+		h = -h
+	}
+	return serviceColors[h%len(serviceColors)]
+}
+
+// FlameHandler serves either a collapsed-stack flame graph or a Gantt
+// chart SVG for the request identified by `?rid=`, selected by
+// `?type=flame|gantt` (default flame). When the flamegraph.pl script
+// from Brendan Gregg's FlameGraph project is on PATH, flame graphs are
+// rendered by shelling out to it; otherwise a simpler SVG is drawn
+// directly.
+func FlameHandler(w http.ResponseWriter, r *http.Request) {
+	c := context(r)
+	rid := r.FormValue("rid")
+
+	data, err := storage.Get(c, rid)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	full, err := decodeFull(data)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+
+	if r.FormValue("type") == "gantt" {
+		writeGantt(w, full)
+		return
+	}
+
+	writeFlame(w, full)
+}
+
+// collapse folds full's RPCStats into Brendan Gregg collapsed-stack
+// lines: "frame;frame;frame count", one per RPC, where the stack is the
+// RPC's service/method followed by its recorded call stack.
+func collapse(full *stats_full) []string {
+	var lines []string
+	for _, s := range full.Stats.RPCStats {
+		frames := append([]string{s.Name()}, s.StackData...)
+		micros := s.Duration.Nanoseconds() / 1000
+		if micros <= 0 {
+			micros = 1
+		}
+		lines = append(lines, fmt.Sprintf("%s %d", strings.Join(frames, ";"), micros))
+	}
+	return lines
+}
+
+// writeFlame renders a flame graph for full, shelling out to
+// flamegraph.pl when available and falling back to an in-process SVG
+// renderer otherwise.
+func writeFlame(w io.Writer, full *stats_full) {
+	lines := collapse(full)
+
+	if path, err := exec.LookPath("flamegraph.pl"); err == nil {
+		var out bytes.Buffer
+		cmd := exec.Command(path)
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		cmd.Stdout = &out
+		if err := cmd.Run(); err == nil {
+			_, _ = out.WriteTo(w)
+			return
+		}
+	}
+
+	writeFlameSVG(w, full)
+}
+
+// flameNode is one frame in the stack tree built by buildFlameTree:
+// every RPC's frames - s.Name() followed by its StackData, root to
+// leaf - are folded into a shared tree so identical stacks accumulate
+// into the same node instead of drawing one box per RPC.
+type flameNode struct {
+	name     string
+	service  string // RPC service of the stacks folded under this node, used for its color
+	value    int64  // nanoseconds; own duration plus the summed values of its children
+	children map[string]*flameNode
+	order    []string // child names in first-seen order, for deterministic layout
+}
+
+func newFlameNode(name string) *flameNode {
+	return &flameNode{name: name, children: map[string]*flameNode{}}
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	if c, ok := n.children[name]; ok {
+		return c
+	}
+	c := newFlameNode(name)
+	n.children[name] = c
+	n.order = append(n.order, name)
+	return c
+}
+
+// buildFlameTree folds full's RPCStats into a stack tree rooted at an
+// unnamed synthetic root: each RPC contributes its frames - s.Name()
+// then its StackData, root to leaf - as a root-to-leaf path, and
+// stacks sharing a prefix share those nodes. Every node's value is then
+// set to the summed duration of everything folded under it.
+func buildFlameTree(full *stats_full) *flameNode {
+	root := newFlameNode("")
+	for _, s := range full.Stats.RPCStats {
+		node := root
+		node = node.child(s.Name())
+		node.service = s.Service
+		for _, frame := range s.StackData {
+			node = node.child(frame)
+			node.service = s.Service
+		}
+		node.value += s.Duration.Nanoseconds()
+	}
+	sumFlameValues(root)
+	return root
+}
+
+func sumFlameValues(n *flameNode) int64 {
+	if len(n.order) == 0 {
+		return n.value
+	}
+	total := n.value
+	for _, name := range n.order {
+		total += sumFlameValues(n.children[name])
+	}
+	n.value = total
+	return total
+}
+
+func flameDepth(n *flameNode) int {
+	max := 0
+	for _, name := range n.order {
+		if d := 1 + flameDepth(n.children[name]); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// writeFlameSVG lays out one rectangle per folded stack frame from
+// buildFlameTree, nested by depth and widthed proportional to its
+// summed duration, without relying on flamegraph.pl.
+func writeFlameSVG(w io.Writer, full *stats_full) {
+	root := buildFlameTree(full)
+	if root.value == 0 {
+		root.value = 1
+	}
+
+	height := rowHeight * (flameDepth(root) + 1)
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", svgWidth, height)
+	fmt.Fprintf(w, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", svgWidth, height)
+
+	writeFlameNode(w, root, -1, 0, float64(svgWidth))
+
+	fmt.Fprintln(w, "</svg>")
+}
+
+// writeFlameNode draws n (unless it's the synthetic root, depth -1)
+// and recurses into its children, each widthed proportional to its
+// share of n's value and packed left to right within [x, x+width).
+func writeFlameNode(w io.Writer, n *flameNode, depth int, x, width float64) {
+	if n.name != "" {
+		fmt.Fprintf(w, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"><title>%s (%s)</title></rect>`+"\n",
+			x, rowHeight*depth, width, rowHeight-2, colorFor(n.service), n.name, time.Duration(n.value))
+	}
+	if n.value == 0 {
+		return
+	}
+
+	childX := x
+	for _, name := range n.order {
+		c := n.children[name]
+		childWidth := width * float64(c.value) / float64(n.value)
+		writeFlameNode(w, c, depth+1, childX, childWidth)
+		childX += childWidth
+	}
+}
+
+// writeGantt renders a self-contained SVG Gantt chart: one rect per RPC
+// ordered by Start, positioned horizontally by elapsed time since the
+// first RPC and vertically by nesting depth inferred from StackData
+// length, so screenshots can be pasted into bug reports without JS.
+func writeGantt(w io.Writer, full *stats_full) {
+	stats := full.Stats.RPCStats
+	if len(stats) == 0 {
+		fmt.Fprintln(w, `<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"></svg>`)
+		return
+	}
+
+	// RPCs are typically appended to RPCStats in completion order, not
+	// start order, so sort by Start before laying out rows.
+	order := make([]int, len(stats))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(intsBy{idx: order, less: func(i, j int) bool {
+		return stats[i].Start.Before(stats[j].Start)
+	}})
+
+	start := stats[order[0]].Start
+	var end = start
+	maxDepth := 0
+	for _, s := range stats {
+		if s.Start.Add(s.Duration).After(end) {
+			end = s.Start.Add(s.Duration)
+		}
+		if len(s.StackData) > maxDepth {
+			maxDepth = len(s.StackData)
+		}
+	}
+	total := end.Sub(start)
+	if total <= 0 {
+		total = 1
+	}
+
+	height := rowHeight * (maxDepth + 2)
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", svgWidth, height)
+	fmt.Fprintf(w, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", svgWidth, height)
+
+	for _, i := range order {
+		s := stats[i]
+		offset := s.Start.Sub(start)
+		x := float64(svgWidth) * float64(offset) / float64(total)
+		width := float64(svgWidth) * float64(s.Duration) / float64(total)
+		if width < 1 {
+			width = 1
+		}
+		y := rowHeight * len(s.StackData)
+		fmt.Fprintf(w, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"><title>%s (%s)</title></rect>`+"\n",
+			x, y, width, rowHeight-2, colorFor(s.Service), s.Name(), s.Duration)
+	}
+
+	fmt.Fprintln(w, "</svg>")
+}
+
+// intsBy sorts an index slice by an arbitrary less function, letting
+// callers order a slice of any element type without copying it or
+// naming its type.
+type intsBy struct {
+	idx  []int
+	less func(i, j int) bool
+}
+
+func (s intsBy) Len() int           { return len(s.idx) }
+func (s intsBy) Swap(i, j int)      { s.idx[i], s.idx[j] = s.idx[j], s.idx[i] }
+func (s intsBy) Less(i, j int) bool { return s.less(s.idx[i], s.idx[j]) }
@@ -17,9 +17,6 @@
 package appstats
 
 import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
@@ -29,7 +26,6 @@ import (
 	"time"
 
 	"appengine"
-	"appengine/memcache"
 	"appengine/user"
 )
 
@@ -76,6 +72,12 @@ func AppstatsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if detailsURL == r.URL.Path {
 		Details(w, r)
+	} else if listURL == r.URL.Path {
+		List(w, r)
+	} else if flameURL == r.URL.Path {
+		FlameHandler(w, r)
+	} else if sampleURL == r.URL.Path {
+		SampleHandler(w, r)
 	} else if fileURL == r.URL.Path {
 		File(w, r)
 	} else if strings.HasPrefix(r.URL.Path, staticURL) {
@@ -86,7 +88,7 @@ func AppstatsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func Details(w http.ResponseWriter, r *http.Request) {
-	key := fmt.Sprintf(keyFull, r.FormValue("rid"))
+	rid := r.FormValue("rid")
 
 	c := context(r)
 
@@ -96,25 +98,35 @@ func Details(w http.ResponseWriter, r *http.Request) {
 		Header          http.Header
 		AllStatsByCount StatsByName
 		Real            time.Duration
+		SampleRate      float64
 	}{
 		Env: map[string]string{
 			"APPLICATION_ID": appengine.AppID(c),
 		},
+		SampleRate: CurrentSampleRate(),
 	}
 
-	item, err := memcache.Get(c, key)
+	data, err := storage.Get(c, rid)
 	if err != nil {
 		templates.ExecuteTemplate(w, "details", v)
 		return
 	}
 
-	full := stats_full{}
-	err = gob.NewDecoder(bytes.NewBuffer(item.Value)).Decode(&full)
+	full, err := decodeFull(data)
 	if err != nil {
 		templates.ExecuteTemplate(w, "details", v)
 		return
 	}
 
+	switch format(r) {
+	case "json":
+		writeJSON(w, full)
+		return
+	case "har":
+		writeHAR(w, full)
+		return
+	}
+
 	byCount := make(map[string]cVal)
 	durationCount := make(map[string]time.Duration)
 	var _real time.Duration
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"appengine"
+	"appengine/user"
+)
+
+const metricsURL = "/appstats/metrics"
+
+// RegisterMetricsHandler wires MetricsHandler onto http.DefaultServeMux
+// at metricsURL. It is opt-in rather than done in an init function:
+// AppstatsHandler's admin/login gate runs before any path switch, which
+// would force a Prometheus scraper through a login redirect before it
+// ever reached the scrape-token check below, so MetricsHandler has to
+// be registered directly, the way net/http/pprof registers its own
+// handlers, for its own auth bypass to take effect. Call this from the
+// embedding app's own init if it wants the endpoint; merely importing
+// this package should not make /appstats/metrics live on its own.
+func RegisterMetricsHandler() {
+	http.HandleFunc(metricsURL, MetricsHandler)
+}
+
+// durationBuckets are the histogram bucket boundaries, in seconds, used
+// for appstats_rpc_duration_seconds_bucket and
+// appstats_request_duration_seconds_bucket.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// scrapeToken, when non-empty, is accepted as a `?token=` query
+// parameter on MetricsHandler in lieu of the normal admin login so that
+// a Prometheus server can poll it unauthenticated by browser.
+var scrapeToken string
+
+// SetScrapeToken configures the token Prometheus must present to
+// MetricsHandler via the `token` query parameter, bypassing the admin
+// login check that guards the rest of AppstatsHandler.
+func SetScrapeToken(token string) {
+	scrapeToken = token
+}
+
+// Registerer lets callers piggyback custom counters on the metrics
+// walk: Observe is called once per recorded RequestStats during the
+// walk, and WriteTo after MetricsHandler has finished emitting its own
+// series.
+type Registerer interface {
+	Observe(rec Record, full *stats_full)
+	WriteTo(w io.Writer)
+}
+
+var registerers []Registerer
+
+// Register adds r to the set of Registerers invoked by MetricsHandler.
+func Register(r Registerer) {
+	registerers = append(registerers, r)
+}
+
+// MetricsHandler exposes Prometheus text-format metrics aggregated from
+// recently recorded RequestStats. It bypasses the admin-only check in
+// AppstatsHandler when a scrape token has been configured via
+// SetScrapeToken and presented as `?token=`.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if scrapeToken == "" || r.FormValue("token") != scrapeToken {
+		if !appengine.IsDevAppServer() {
+			if u := user.Current(c); u == nil || !u.Admin {
+				serveError(w, fmt.Errorf("missing or invalid scrape token"))
+				return
+			}
+		}
+	}
+
+	records, err := storage.List(c, Filter{})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	calls := map[labelKey]int64{}
+	costMicros := map[labelKey]int64{}
+	durationCounts := map[labelKey][]int64{}
+	requestDurations := []int64{}
+
+	for _, rec := range records {
+		data, err := storage.Get(c, rec.RID)
+		if err != nil {
+			continue
+		}
+		full, err := decodeFull(data)
+		if err != nil {
+			continue
+		}
+
+		var total int64
+		for _, s := range full.Stats.RPCStats {
+			label := labelKey{Service: s.Service, Method: s.Method, Path: rec.Path}
+			calls[label]++
+			costMicros[label] += s.Cost
+			durationCounts[label] = append(durationCounts[label], s.Duration.Nanoseconds())
+			total += s.Duration.Nanoseconds()
+		}
+		requestDurations = append(requestDurations, total)
+
+		for _, reg := range registerers {
+			reg.Observe(rec, full)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# TYPE appstats_rpc_calls_total counter")
+	for _, label := range sortedLabelKeys(callsKeys(calls)) {
+		fmt.Fprintf(w, "appstats_rpc_calls_total{service=%q,method=%q,path=%q} %d\n", label.Service, label.Method, label.Path, calls[label])
+	}
+
+	fmt.Fprintln(w, "# TYPE appstats_rpc_cost_micros_total counter")
+	for _, label := range sortedLabelKeys(costKeys(costMicros)) {
+		fmt.Fprintf(w, "appstats_rpc_cost_micros_total{service=%q,method=%q,path=%q} %d\n", label.Service, label.Method, label.Path, costMicros[label])
+	}
+
+	fmt.Fprintln(w, "# TYPE appstats_rpc_duration_seconds histogram")
+	for _, label := range sortedLabelKeys(durationKeys(durationCounts)) {
+		labels := fmt.Sprintf("service=%q,method=%q,path=%q", label.Service, label.Method, label.Path)
+		writeHistogram(w, "appstats_rpc_duration_seconds", labels, durationCounts[label])
+	}
+
+	fmt.Fprintln(w, "# TYPE appstats_request_duration_seconds histogram")
+	writeHistogram(w, "appstats_request_duration_seconds", "", requestDurations)
+
+	for _, reg := range registerers {
+		reg.WriteTo(w)
+	}
+}
+
+// labelKey identifies one Prometheus label set. Using a struct instead
+// of a comma-joined string avoids misparsing fields (a request path,
+// for instance) that themselves contain commas.
+type labelKey struct {
+	Service string
+	Method  string
+	Path    string
+}
+
+func callsKeys(m map[labelKey]int64) []labelKey {
+	keys := make([]labelKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func costKeys(m map[labelKey]int64) []labelKey {
+	return callsKeys(m)
+}
+
+func durationKeys(m map[labelKey][]int64) []labelKey {
+	keys := make([]labelKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// labelKeysByName sorts labelKeys for stable metrics output.
+type labelKeysByName []labelKey
+
+func (l labelKeysByName) Len() int      { return len(l) }
+func (l labelKeysByName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l labelKeysByName) Less(i, j int) bool {
+	if l[i].Service != l[j].Service {
+		return l[i].Service < l[j].Service
+	}
+	if l[i].Method != l[j].Method {
+		return l[i].Method < l[j].Method
+	}
+	return l[i].Path < l[j].Path
+}
+
+func sortedLabelKeys(keys []labelKey) []labelKey {
+	sort.Sort(labelKeysByName(keys))
+	return keys
+}
+
+// writeHistogram emits Prometheus bucket, sum, and count lines for name
+// from a set of nanosecond-resolution sample durations.
+func writeHistogram(w io.Writer, name, labels string, samplesNanos []int64) {
+	counts := make([]int64, len(durationBuckets))
+	var sum float64
+	for _, ns := range samplesNanos {
+		seconds := float64(ns) / 1e9
+		sum += seconds
+		for i, b := range durationBuckets {
+			if seconds <= b {
+				counts[i]++
+			}
+		}
+	}
+
+	for i, b := range durationBuckets {
+		le := fmt.Sprintf("%v", b)
+		if labels == "" {
+			fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, counts[i])
+		} else {
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, le, counts[i])
+		}
+	}
+	if labels == "" {
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, len(samplesNanos))
+		fmt.Fprintf(w, "%s_sum %v\n", name, sum)
+		fmt.Fprintf(w, "%s_count %d\n", name, len(samplesNanos))
+	} else {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, len(samplesNanos))
+		fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, len(samplesNanos))
+	}
+}
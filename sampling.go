@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// samplingMu guards shouldRecordFunc and currentAdaptive against the race
+// between SampleHandler's POST reconfiguring the policy and concurrent
+// requests consulting it through put.
+var samplingMu sync.RWMutex
+
+// shouldRecordFunc holds the current policy. Read and written only
+// through shouldRecord/setShouldRecord so every access is guarded by
+// samplingMu.
+var shouldRecordFunc func(*http.Request) bool = func(*http.Request) bool { return true }
+
+// ShouldRecord decides whether the recorder should keep full stats for
+// a given request. It is consulted by whatever NewContext/recorder
+// wraps the handler before it pays the cost of gob-encoding into
+// Storage. The default always records, preserving existing behavior.
+//
+// ShouldRecord is a function, not an assignable variable: the policy it
+// applies is set through SampleAll, SampleFraction, SampleByHeader or
+// SampleAdaptive, which store it under samplingMu so concurrent request
+// handling always sees a consistent policy.
+func ShouldRecord(r *http.Request) bool {
+	return shouldRecord(r)
+}
+
+func shouldRecord(r *http.Request) bool {
+	samplingMu.RLock()
+	f := shouldRecordFunc
+	samplingMu.RUnlock()
+	return f(r)
+}
+
+// setShouldRecord installs a non-adaptive policy f and clears
+// currentAdaptive, so CurrentSampleRate and keepOutlier stop applying a
+// previously configured adaptive sampler.
+func setShouldRecord(f func(*http.Request) bool) {
+	samplingMu.Lock()
+	shouldRecordFunc = f
+	currentAdaptive = nil
+	samplingMu.Unlock()
+}
+
+// SampleAll restores the default policy of recording every request.
+func SampleAll() {
+	setShouldRecord(func(*http.Request) bool { return true })
+}
+
+// SampleFraction sets a fixed-probability sampling policy: roughly
+// fraction of requests (0 to 1) are recorded.
+func SampleFraction(fraction float64) {
+	setShouldRecord(func(r *http.Request) bool {
+		return rng.Float64() < fraction
+	})
+}
+
+// SampleByHeader sets a deterministic, hash-based sampling policy keyed
+// on the named request header (typically a trace ID): a given value is
+// either always kept or always dropped, so a trace sampled on one hop
+// stays sampled on every hop that shares the same header.
+func SampleByHeader(header string, fraction float64) {
+	setShouldRecord(func(r *http.Request) bool {
+		id := r.Header.Get(header)
+		if id == "" {
+			return rng.Float64() < fraction
+		}
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return float64(h.Sum32())/float64(^uint32(0)) < fraction
+	})
+}
+
+// lockedRand makes a *rand.Rand safe for the concurrent Float64 calls
+// SampleFraction and SampleByHeader make from every request's goroutine;
+// rand.Rand itself is not safe for concurrent use.
+type lockedRand struct {
+	mu  sync.Mutex
+	src *rand.Rand
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.src.Float64()
+}
+
+// rng is the source consulted by SampleFraction and SampleByHeader's
+// fallback. It is a package var, swappable in tests, seeded from the
+// wall clock rather than read from time.Now() per call so successive
+// calls under load don't land on correlated, monotonically increasing
+// values.
+var rng = &lockedRand{src: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// adaptiveSampler implements a token-bucket policy that targets a
+// maximum number of recordings per second, while always keeping
+// requests slower or costlier than a configured threshold regardless of
+// bucket state.
+type adaptiveSampler struct {
+	mu           sync.Mutex
+	tokens       float64
+	maxTokens    float64
+	refillPerSec float64
+	last         time.Time
+
+	costThreshold     int64
+	durationThreshold time.Duration
+}
+
+// currentAdaptive holds the last-configured adaptive sampler, if any,
+// so CurrentSampleRate can report it on the admin page.
+var currentAdaptive *adaptiveSampler
+
+// SampleAdaptive sets a token-bucket adaptive policy targeting at most
+// maxPerSec recordings per second. Requests whose cost exceeds
+// keepIfCostExceeds, or whose duration exceeds keepIfSlowerThan, are
+// always recorded regardless of the bucket, so a busy service still
+// captures its slow or expensive outliers.
+func SampleAdaptive(maxPerSec float64, keepIfCostExceeds int64, keepIfSlowerThan time.Duration) {
+	s := &adaptiveSampler{
+		tokens:            maxPerSec,
+		maxTokens:         maxPerSec,
+		refillPerSec:      maxPerSec,
+		last:              time.Now(),
+		costThreshold:     keepIfCostExceeds,
+		durationThreshold: keepIfSlowerThan,
+	}
+
+	samplingMu.Lock()
+	currentAdaptive = s
+	shouldRecordFunc = func(r *http.Request) bool {
+		return s.allow()
+	}
+	samplingMu.Unlock()
+}
+
+func (s *adaptiveSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.last).Seconds()
+	s.last = now
+
+	s.tokens += elapsed * s.refillPerSec
+	if s.tokens > s.maxTokens {
+		s.tokens = s.maxTokens
+	}
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// keepOutlier reports whether rec should be recorded even though the
+// adaptive bucket was empty, because it exceeded the configured cost or
+// duration threshold.
+func keepOutlier(rec Record, duration time.Duration) bool {
+	samplingMu.RLock()
+	s := currentAdaptive
+	samplingMu.RUnlock()
+
+	if s == nil {
+		return false
+	}
+	if s.costThreshold != 0 && rec.Cost > s.costThreshold {
+		return true
+	}
+	if s.durationThreshold != 0 && duration > s.durationThreshold {
+		return true
+	}
+	return false
+}
+
+// CurrentSampleRate reports the configured target recordings/sec for
+// display on the main appstats page. It returns 0 if no adaptive policy
+// is active (fixed or hash-based sampling don't have a fixed rate).
+func CurrentSampleRate() float64 {
+	samplingMu.RLock()
+	s := currentAdaptive
+	samplingMu.RUnlock()
+
+	if s == nil {
+		return 0
+	}
+	return s.refillPerSec
+}
+
+const sampleURL = "/appstats/sample"
+
+// SampleHandler lets admins override the sample rate live: a POST with
+// a `rate` form value (recordings/sec) switches to SampleAdaptive with
+// that target, keeping the existing cost/duration outlier thresholds;
+// a GET just reports the current rate.
+func SampleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		_, _ = w.Write([]byte(formatRate(CurrentSampleRate())))
+		return
+	}
+
+	rate, err := parseRate(r.FormValue("rate"))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	samplingMu.RLock()
+	var costThreshold int64
+	var durationThreshold time.Duration
+	if currentAdaptive != nil {
+		costThreshold = currentAdaptive.costThreshold
+		durationThreshold = currentAdaptive.durationThreshold
+	}
+	samplingMu.RUnlock()
+
+	SampleAdaptive(rate, costThreshold, durationThreshold)
+
+	_, _ = w.Write([]byte(formatRate(CurrentSampleRate())))
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', 2, 64)
+}
+
+func parseRate(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,456 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Record identifies a single stored stats_full entry.
+type Record struct {
+	RID       string
+	Path      string
+	Status    int
+	Cost      int64
+	Timestamp time.Time
+}
+
+// Filter narrows a List call to a subset of stored records. Zero values
+// are treated as "no restriction" for that field.
+type Filter struct {
+	PathPrefix string
+	Status     int
+	MinCost    int64
+	MaxCost    int64
+	Since      time.Time
+	Until      time.Time
+}
+
+func (f Filter) matches(r Record) bool {
+	if f.PathPrefix != "" && !strings.HasPrefix(r.Path, f.PathPrefix) {
+		return false
+	}
+	if f.Status != 0 && r.Status != f.Status {
+		return false
+	}
+	if f.MinCost != 0 && r.Cost < f.MinCost {
+		return false
+	}
+	if f.MaxCost != 0 && r.Cost > f.MaxCost {
+		return false
+	}
+	if !f.Since.IsZero() && r.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Storage persists stats_full records beyond the lifetime of a single
+// memcache entry so that Details can be served, and requests can be
+// listed and filtered, long after the recording request has finished.
+//
+// Implementations should be safe for concurrent use, since a single
+// recorder may write from many requests at once.
+type Storage interface {
+	// Put stores the gob-encoded stats_full payload under rec.RID, along
+	// with rec's path, status, cost and timestamp.
+	Put(c appengine.Context, rec Record, data []byte) error
+
+	// Get returns the gob-encoded stats_full payload previously stored
+	// under rid, or a non-nil error if none exists (memcache.ErrCacheMiss
+	// for memcacheStorage; the backend's own error for the others).
+	Get(c appengine.Context, rid string) ([]byte, error)
+
+	// List returns the records matching filter, most recent first.
+	List(c appengine.Context, filter Filter) ([]Record, error)
+}
+
+// storage is the backend used by Details, List, and the recorder. It
+// defaults to memcacheStorage so behavior is unchanged unless an
+// operator opts into a durable backend with SetStorage.
+var storage Storage = memcacheStorage{}
+
+// SetStorage overrides the Storage backend used to persist and query
+// RequestStats. Call it from an init function before serving traffic.
+func SetStorage(s Storage) {
+	storage = s
+}
+
+// memcacheStorage is the original, memcache-only backend: it keeps
+// Details working exactly as before, but List always returns nothing
+// since memcache has no query facility.
+type memcacheStorage struct{}
+
+func (memcacheStorage) Put(c appengine.Context, rec Record, data []byte) error {
+	return memcache.Set(c, &memcache.Item{
+		Key:   fmt.Sprintf(keyFull, rec.RID),
+		Value: data,
+	})
+}
+
+func (memcacheStorage) Get(c appengine.Context, rid string) ([]byte, error) {
+	item, err := memcache.Get(c, fmt.Sprintf(keyFull, rid))
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (memcacheStorage) List(c appengine.Context, filter Filter) ([]Record, error) {
+	return nil, nil
+}
+
+// datastoreRecord is the Datastore entity shape backing datastoreStorage.
+type datastoreRecord struct {
+	Path      string
+	Status    int
+	Cost      int64
+	Timestamp time.Time
+	Data      []byte `datastore:",noindex"`
+}
+
+// datastoreKind is the Datastore kind used to store appstats records
+// when datastoreStorage is selected.
+const datastoreKind = "AppstatsRecord"
+
+// datastoreStorage persists records in Datastore, keyed by rid, so they
+// survive memcache eviction and can be listed and filtered by path,
+// status, cost, and time window. It also mirrors writes through
+// memcacheStorage so hot reads of the most recent request stay fast.
+type datastoreStorage struct{}
+
+// NewDatastoreStorage returns a Storage backend that durably persists
+// records in Datastore.
+func NewDatastoreStorage() Storage {
+	return datastoreStorage{}
+}
+
+func (datastoreStorage) key(c appengine.Context, rid string) *datastore.Key {
+	return datastore.NewKey(c, datastoreKind, rid, 0, nil)
+}
+
+func (s datastoreStorage) Put(c appengine.Context, rec Record, data []byte) error {
+	_, err := datastore.Put(c, s.key(c, rec.RID), &datastoreRecord{
+		Path:      rec.Path,
+		Status:    rec.Status,
+		Cost:      rec.Cost,
+		Timestamp: rec.Timestamp,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	return memcacheStorage{}.Put(c, rec, data)
+}
+
+func (s datastoreStorage) Get(c appengine.Context, rid string) ([]byte, error) {
+	if data, err := (memcacheStorage{}).Get(c, rid); err == nil {
+		return data, nil
+	}
+
+	var dr datastoreRecord
+	if err := datastore.Get(c, s.key(c, rid), &dr); err != nil {
+		return nil, err
+	}
+	return dr.Data, nil
+}
+
+func (s datastoreStorage) List(c appengine.Context, filter Filter) ([]Record, error) {
+	q := datastore.NewQuery(datastoreKind).Order("-Timestamp").Limit(500)
+	if filter.PathPrefix != "" {
+		q = q.Filter("Path >=", filter.PathPrefix).Filter("Path <", filter.PathPrefix+"￿")
+	}
+	if filter.Status != 0 {
+		q = q.Filter("Status =", filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		q = q.Filter("Timestamp >=", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		q = q.Filter("Timestamp <=", filter.Until)
+	}
+
+	var out []Record
+	var keys []*datastore.Key
+	var drs []datastoreRecord
+	keys, err := q.GetAll(c, &drs)
+	if err != nil {
+		return nil, err
+	}
+	for i, dr := range drs {
+		// The path prefix and cost range are also checked in memory on
+		// each fetched record.
+		if filter.PathPrefix != "" && !strings.HasPrefix(dr.Path, filter.PathPrefix) {
+			continue
+		}
+		if filter.MinCost != 0 && dr.Cost < filter.MinCost {
+			continue
+		}
+		if filter.MaxCost != 0 && dr.Cost > filter.MaxCost {
+			continue
+		}
+		out = append(out, Record{
+			RID:       keys[i].StringID(),
+			Path:      dr.Path,
+			Status:    dr.Status,
+			Cost:      dr.Cost,
+			Timestamp: dr.Timestamp,
+		})
+	}
+	return out, nil
+}
+
+// decodeFull gob-decodes a stats_full payload as stored by put.
+func decodeFull(data []byte) (*stats_full, error) {
+	full := &stats_full{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(full); err != nil {
+		return nil, err
+	}
+	return full, nil
+}
+
+// BlobClient abstracts the handful of operations gcsStorage and
+// s3Storage need from an object store. It exists so this package
+// doesn't have to vendor a particular Cloud Storage or AWS SDK: wire in
+// cloud.google.com/go/storage, aws-sdk-go, or appengine/file, whichever
+// fits the deployment.
+type BlobClient interface {
+	Put(c appengine.Context, key string, data []byte) error
+	Get(c appengine.Context, key string) ([]byte, error)
+}
+
+// gcsStorage persists records as objects in a Cloud Storage bucket,
+// through a caller-supplied BlobClient, and mirrors writes through
+// memcacheStorage for fast hot reads of the most recent request. List
+// is unsupported: object stores have no native range-query facility,
+// so operators who need List should pair this with datastoreStorage's
+// metadata index instead.
+type gcsStorage struct {
+	client BlobClient
+}
+
+// NewGCSStorage returns a Storage backend that persists records as
+// objects in Cloud Storage (or S3; BlobClient is storage-agnostic) via
+// client. Reads try memcache first and fall back to client.
+func NewGCSStorage(client BlobClient) Storage {
+	return gcsStorage{client: client}
+}
+
+func (s gcsStorage) Put(c appengine.Context, rec Record, data []byte) error {
+	if err := s.client.Put(c, rec.RID, data); err != nil {
+		return err
+	}
+	return memcacheStorage{}.Put(c, rec, data)
+}
+
+func (s gcsStorage) Get(c appengine.Context, rid string) ([]byte, error) {
+	if data, err := (memcacheStorage{}).Get(c, rid); err == nil {
+		return data, nil
+	}
+	return s.client.Get(c, rid)
+}
+
+func (gcsStorage) List(c appengine.Context, filter Filter) ([]Record, error) {
+	return nil, nil
+}
+
+// NewS3Storage returns a Storage backend that persists records as
+// objects in S3 via client. Reads try memcache first and fall back to
+// client.
+// It is the same shape as gcsStorage because both backends are plain
+// key/blob object stores behind BlobClient; only the client
+// implementation (signing, bucket, region) differs.
+func NewS3Storage(client BlobClient) Storage {
+	return gcsStorage{client: client}
+}
+
+// RedisClient abstracts the subset of Redis commands redisStorage
+// needs, so this package doesn't vendor a particular client (e.g.
+// redigo) or assume how it reaches Redis on a runtime, like classic App
+// Engine, that has no raw outbound sockets without the billed-only
+// appengine/socket API.
+type RedisClient interface {
+	Set(c appengine.Context, key string, data []byte) error
+	Get(c appengine.Context, key string) ([]byte, error)
+}
+
+// redisStorage combines a Redis-backed durable store with memcache for
+// hot reads, the way the request described: memcache absorbs the
+// read traffic for the request that was just recorded, Redis is the
+// fallback once that entry is evicted. Like memcacheStorage, List
+// returns nothing; Redis has no query facility either, so List still
+// needs datastoreStorage's metadata index.
+type redisStorage struct {
+	client RedisClient
+}
+
+// NewRedisStorage returns a Storage backend that persists records in
+// Redis via client. Reads try memcache first and fall back to Redis.
+func NewRedisStorage(client RedisClient) Storage {
+	return redisStorage{client: client}
+}
+
+func (s redisStorage) Put(c appengine.Context, rec Record, data []byte) error {
+	if err := s.client.Set(c, rec.RID, data); err != nil {
+		return err
+	}
+	return memcacheStorage{}.Put(c, rec, data)
+}
+
+func (s redisStorage) Get(c appengine.Context, rid string) ([]byte, error) {
+	if data, err := (memcacheStorage{}).Get(c, rid); err == nil {
+		return data, nil
+	}
+	return s.client.Get(c, rid)
+}
+
+func (redisStorage) List(c appengine.Context, filter Filter) ([]Record, error) {
+	return nil, nil
+}
+
+// put is a convenience wrapper the recorder calls to double-write a
+// stats_full gob into the configured Storage keyed by rid, timestamp,
+// and path. r is nil when the caller has no *http.Request to consult
+// ShouldRecord with, in which case the write always proceeds.
+func put(c appengine.Context, r *http.Request, rid, path string, status int, cost int64, duration time.Duration, full *stats_full) error {
+	rec := Record{
+		RID:       rid,
+		Path:      path,
+		Status:    status,
+		Cost:      cost,
+		Timestamp: time.Now(),
+	}
+
+	if r != nil && !ShouldRecord(r) && !keepOutlier(rec, duration) {
+		return nil
+	}
+
+	if r != nil {
+		if err := exportTrace(c, r, full); err != nil {
+			c.Errorf("appstats: trace export: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(full); err != nil {
+		return err
+	}
+	return storage.Put(c, rec, buf.Bytes())
+}
+
+const listURL = "/appstats/list"
+
+// List renders the set of recently stored requests, optionally narrowed
+// by the path, status, cost, and time query parameters understood by
+// parseFilter. It is only useful with a Storage backend that implements
+// List, such as datastoreStorage; the default memcacheStorage always
+// returns an empty result set.
+func List(w http.ResponseWriter, r *http.Request) {
+	c := context(r)
+
+	filter, err := parseFilter(r)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	records, err := storage.List(c, filter)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if format(r) == "json" {
+		writeListJSON(w, records)
+		return
+	}
+
+	v := struct {
+		Env        map[string]string
+		Records    []Record
+		SampleRate float64
+	}{
+		Env: map[string]string{
+			"APPLICATION_ID": appengine.AppID(c),
+		},
+		Records:    records,
+		SampleRate: CurrentSampleRate(),
+	}
+
+	_ = templates.ExecuteTemplate(w, "list", v)
+}
+
+func parseFilter(r *http.Request) (Filter, error) {
+	f := Filter{
+		PathPrefix: r.FormValue("path"),
+	}
+
+	if s := r.FormValue("status"); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil {
+			return f, err
+		}
+		f.Status = status
+	}
+
+	if s := r.FormValue("min_cost"); s != "" {
+		cost, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return f, err
+		}
+		f.MinCost = cost
+	}
+
+	if s := r.FormValue("max_cost"); s != "" {
+		cost, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return f, err
+		}
+		f.MaxCost = cost
+	}
+
+	if s := r.FormValue("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, err
+		}
+		f.Since = t
+	}
+
+	if s := r.FormValue("until"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, err
+		}
+		f.Until = t
+	}
+
+	return f, nil
+}
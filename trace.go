@@ -0,0 +1,385 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package appstats
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// Span is the exporter-agnostic representation of a single RPC, built
+// from an RPCStats entry before being handed to a SpanExporter.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Service    string
+	Method     string
+	Start      time.Time
+	Duration   time.Duration
+	CostMicros int64
+	Frames     []SpanFrame
+}
+
+// SpanFrame carries one parsed StackData entry. The OTLP and Zipkin
+// exporters send only a span's first frame, as code.function,
+// code.filepath and code.lineno attributes (tags) on the span itself;
+// they emit no span events, and the remaining frames are not sent.
+type SpanFrame struct {
+	Function string
+	Filepath string
+	Lineno   int
+}
+
+// SpanExporter sends a batch of spans belonging to one request to a
+// tracing backend. c must be used for any outbound call an
+// implementation makes: the classic App Engine runtime this package
+// targets has no raw outbound sockets, only appengine/urlfetch bound to
+// the request's Context.
+type SpanExporter interface {
+	Export(c appengine.Context, spans []Span) error
+}
+
+// traceMu guards traceExporter, traceSync, and batch against the race
+// between SetSpanExporter/FlushBatch reconfiguring or draining them and
+// exportTrace appending to batch from every recorded request's
+// goroutine, the same hazard sampling.go's samplingMu guards against.
+var traceMu sync.Mutex
+
+// traceExporter is the exporter used by the recorder, or nil if trace
+// export is disabled.
+var traceExporter SpanExporter
+
+// traceSync selects synchronous export (one call to Export per
+// request) versus batched export flushed by FlushBatch.
+var traceSync = true
+
+// batch accumulates spans for batched export.
+var batch []Span
+
+// SetSpanExporter configures the exporter spans are sent to, and
+// whether export happens synchronously (one Export call per request)
+// or is buffered and flushed by FlushBatch.
+func SetSpanExporter(e SpanExporter, sync bool) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	traceExporter = e
+	traceSync = sync
+	batch = nil
+}
+
+// FlushBatch sends any spans accumulated since the last flush. It is a
+// no-op in sync mode. Callers running in batched mode are responsible
+// for calling it periodically (e.g. from a cron handler), passing a
+// Context for that invocation's own urlfetch calls.
+func FlushBatch(c appengine.Context) error {
+	traceMu.Lock()
+	e, sync, spans := traceExporter, traceSync, batch
+	batch = nil
+	traceMu.Unlock()
+
+	if e == nil || sync || len(spans) == 0 {
+		return nil
+	}
+	return e.Export(c, spans)
+}
+
+// traceparent is the subset of the W3C Trace Context header this
+// package understands: version-traceid-parentid-flags.
+type traceparent struct {
+	TraceID  string
+	ParentID string
+}
+
+// parseTraceparent parses the incoming `traceparent` header, if any, so
+// appstats spans nest under an upstream trace instead of starting a new
+// one.
+func parseTraceparent(r *http.Request) (traceparent, bool) {
+	h := r.Header.Get("traceparent")
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 {
+		return traceparent{}, false
+	}
+	return traceparent{TraceID: parts[1], ParentID: parts[2]}, true
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// exportTrace builds a root Span for the request itself plus one child
+// Span per RPCStats entry in full, nested under the incoming
+// traceparent when present, and hands them to the configured
+// SpanExporter either immediately or via the batch buffer.
+func exportTrace(c appengine.Context, r *http.Request, full *stats_full) error {
+	traceMu.Lock()
+	e, isSync := traceExporter, traceSync
+	traceMu.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	tp, ok := parseTraceparent(r)
+	traceID := tp.TraceID
+	if !ok || traceID == "" {
+		traceID = newID(16)
+	}
+
+	// The root span represents the request itself. If an upstream
+	// traceparent was present, it nests under that trace's parent span;
+	// otherwise it has no parent, since this is the root of a new trace.
+	// Every RPC span below is a child of this root, rather than a child
+	// of a rootSpanID that is otherwise never itself exported.
+	rootSpanID := newID(8)
+	var rootParent string
+	if ok {
+		rootParent = tp.ParentID
+	}
+
+	rootStart, rootDuration := requestSpan(full)
+
+	spans := make([]Span, 0, len(full.Stats.RPCStats)+1)
+	spans = append(spans, Span{
+		TraceID:  traceID,
+		SpanID:   rootSpanID,
+		ParentID: rootParent,
+		Name:     r.URL.Path,
+		Start:    rootStart,
+		Duration: rootDuration,
+	})
+
+	for _, s := range full.Stats.RPCStats {
+		var frames []SpanFrame
+		for _, line := range s.StackData {
+			frames = append(frames, parseFrame(line))
+		}
+
+		spans = append(spans, Span{
+			TraceID:    traceID,
+			SpanID:     newID(8),
+			ParentID:   rootSpanID,
+			Name:       s.Name(),
+			Service:    s.Service,
+			Method:     s.Method,
+			Start:      s.Start,
+			Duration:   s.Duration,
+			CostMicros: s.Cost,
+			Frames:     frames,
+		})
+	}
+
+	if isSync {
+		return e.Export(c, spans)
+	}
+
+	traceMu.Lock()
+	batch = append(batch, spans...)
+	traceMu.Unlock()
+	return nil
+}
+
+// requestSpan derives a start time and duration for the request as a
+// whole from its RPCStats, since stats_full carries per-RPC timing but
+// no single request-level span of its own: the root span runs from the
+// earliest RPC start to the latest RPC end. A request with no RPCs gets
+// a zero-duration span starting now.
+func requestSpan(full *stats_full) (time.Time, time.Duration) {
+	stats := full.Stats.RPCStats
+	if len(stats) == 0 {
+		return time.Now(), 0
+	}
+
+	start := stats[0].Start
+	end := stats[0].Start.Add(stats[0].Duration)
+	for _, s := range stats[1:] {
+		if s.Start.Before(start) {
+			start = s.Start
+		}
+		if e := s.Start.Add(s.Duration); e.After(end) {
+			end = e
+		}
+	}
+	return start, end.Sub(start)
+}
+
+// parseFrame splits a "file.go:123 funcname" StackData line into its
+// code.filepath/code.lineno/code.function parts. Lines that don't match
+// are returned with Function set to the raw text.
+func parseFrame(line string) SpanFrame {
+	fields := strings.SplitN(line, " ", 2)
+	loc := fields[0]
+	fn := ""
+	if len(fields) > 1 {
+		fn = fields[1]
+	}
+
+	parts := strings.SplitN(loc, ":", 2)
+	if len(parts) != 2 {
+		return SpanFrame{Function: line}
+	}
+	var lineno int
+	fmt.Sscanf(parts[1], "%d", &lineno)
+	return SpanFrame{Function: fn, Filepath: parts[0], Lineno: lineno}
+}
+
+// otlpSpan and otlpExporter adapt Span to OTLP/HTTP's JSON encoding.
+// Only the fields appstats populates are included; a real OTLP
+// collector tolerates the omitted ones.
+type otlpExporter struct {
+	endpoint string
+}
+
+// NewOTLPExporter returns a SpanExporter that POSTs spans to an
+// OTLP/HTTP collector endpoint (e.g. "http://localhost:4318/v1/traces").
+func NewOTLPExporter(endpoint string) SpanExporter {
+	return &otlpExporter{endpoint: endpoint}
+}
+
+type otlpSpan struct {
+	TraceID           string            `json:"traceId"`
+	SpanID            string            `json:"spanId"`
+	ParentSpanID      string            `json:"parentSpanId,omitempty"`
+	Name              string            `json:"name"`
+	StartTimeUnixNano string            `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string            `json:"endTimeUnixNano"`
+	Attributes        map[string]string `json:"attributes"`
+}
+
+func (e *otlpExporter) Export(c appengine.Context, spans []Span) error {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		attrs := map[string]string{
+			"appengine.cost_micros": fmt.Sprintf("%d", s.CostMicros),
+			"rpc.service":           s.Service,
+			"rpc.method":            s.Method,
+		}
+		if len(s.Frames) > 0 {
+			attrs["code.function"] = s.Frames[0].Function
+			attrs["code.filepath"] = s.Frames[0].Filepath
+			attrs["code.lineno"] = fmt.Sprintf("%d", s.Frames[0].Lineno)
+		}
+
+		otlpSpans = append(otlpSpans, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			StartTimeUnixNano: fmt.Sprintf("%d", s.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprintf("%d", s.Start.Add(s.Duration).UnixNano()),
+			Attributes:        attrs,
+		})
+	}
+
+	body, err := json.Marshal(struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}{
+		ResourceSpans: []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		}{{
+			ScopeSpans: []struct {
+				Spans []otlpSpan `json:"spans"`
+			}{{Spans: otlpSpans}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := urlfetch.Client(c).Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// zipkinExporter adapts Span to Zipkin v2 JSON.
+type zipkinExporter struct {
+	endpoint string
+}
+
+// NewZipkinExporter returns a SpanExporter that POSTs spans to a Zipkin
+// v2 JSON endpoint (e.g. "http://localhost:9411/api/v2/spans").
+func NewZipkinExporter(endpoint string) SpanExporter {
+	return &zipkinExporter{endpoint: endpoint}
+}
+
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint map[string]string `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags"`
+}
+
+func (e *zipkinExporter) Export(c appengine.Context, spans []Span) error {
+	var zspans []zipkinSpan
+	for _, s := range spans {
+		tags := map[string]string{
+			"appengine.cost_micros": fmt.Sprintf("%d", s.CostMicros),
+		}
+		if len(s.Frames) > 0 {
+			tags["code.function"] = s.Frames[0].Function
+			tags["code.filepath"] = s.Frames[0].Filepath
+			tags["code.lineno"] = fmt.Sprintf("%d", s.Frames[0].Lineno)
+		}
+
+		zspans = append(zspans, zipkinSpan{
+			TraceID:       s.TraceID,
+			ID:            s.SpanID,
+			ParentID:      s.ParentID,
+			Name:          s.Name,
+			Timestamp:     s.Start.UnixNano() / 1000,
+			Duration:      s.Duration.Nanoseconds() / 1000,
+			LocalEndpoint: map[string]string{"serviceName": s.Service},
+			Tags:          tags,
+		})
+	}
+
+	body, err := json.Marshal(zspans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := urlfetch.Client(c).Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}